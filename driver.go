@@ -0,0 +1,825 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/containerd/fifo"
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/docker/docker/daemon/logger"
+	protoio "github.com/gogo/protobuf/io"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// Environment variables that can be set on a container to override the
+// driver's global defaults on a per-container basis.
+const (
+	ENV_TOPIC          = "KAFKA_TOPIC"
+	ENV_LOG_TAG        = "LOG_TAG"
+	ENV_COMPRESSION    = "KAFKA_COMPRESSION"
+	ENV_CONSUMER_GROUP = "KAFKA_CONSUMER_GROUP"
+)
+
+// Supported modes for how the Kafka message key is derived.
+const (
+	KEY_BY_NONE        = "none"
+	KEY_BY_CONTAINERID = "containerid"
+	KEY_BY_TIMESTAMP   = "timestamp"
+)
+
+// Kafka record header names carrying container metadata alongside every log
+// message, so a consumer (including our own reader) can filter and route
+// without having to JSON-decode the body.
+const (
+	containerIDHeader   = "container_id"
+	containerNameHeader = "container_name"
+	imageIDHeader       = "container_image_id"
+	imageNameHeader     = "container_image_name"
+	hostnameHeader      = "hostname"
+	sourceHeader        = "source"
+	partialHeader       = "partial"
+	tagHeader           = "tag"
+)
+
+// headersOnlyOpt is the --log-opt key that, when set to "true", drops the
+// metadata already carried in Kafka record headers from the JSON body.
+const headersOnlyOpt = "headers_only"
+
+// TAG is the default tag applied to messages when none is configured.
+const TAG = "docker"
+
+// readIdleTimeout is how long a non-follow readLogsFromKafka call waits for
+// a new message before concluding the backlog has been fully replayed and
+// closing the stream handed back to Docker.
+const readIdleTimeout = 750 * time.Millisecond
+
+// Bounds on the backoff between attempts to rejoin the consumer group
+// after a session ends in error (e.g. the broker connection drops).
+const (
+	readerReconnectInitialBackoff = 250 * time.Millisecond
+	readerReconnectMaxBackoff     = 30 * time.Second
+)
+
+// LogMessage is the JSON payload written to Kafka for every log line. The
+// fields also carried as Kafka record headers are tagged omitempty so that
+// headers_only containers can omit them from the body entirely.
+type LogMessage struct {
+	Line               string    `json:"line"`
+	Source             string    `json:"source,omitempty"`
+	Partial            bool      `json:"partial,omitempty"`
+	Timestamp          time.Time `json:"timestamp"`
+	ContainerId        string    `json:"container_id,omitempty"`
+	ContainerName      string    `json:"container_name,omitempty"`
+	ContainerImageId   string    `json:"container_image_id,omitempty"`
+	ContainerImageName string    `json:"container_image_name,omitempty"`
+	Hostname           string    `json:"hostname,omitempty"`
+	Tag                string    `json:"tag,omitempty"`
+}
+
+// logPair couples a docker log fifo with the Kafka producer it is shipped
+// through, plus the container metadata needed to build each LogMessage.
+// retryDone is closed by StopLogging to tell handleProducerErrors and its
+// retry goroutines to stop touching producer before it's closed; retryWG
+// lets StopLogging wait for them to do so.
+type logPair struct {
+	producer sarama.AsyncProducer
+	stream   io.ReadCloser
+	info     logger.Info
+
+	retryDone chan struct{}
+	retryWG   sync.WaitGroup
+}
+
+// ReaderHealth describes the state of the consumer-group session reading
+// logs back out of Kafka for a single container, for health reporting.
+type ReaderHealth struct {
+	Connected bool
+	Claims    map[string][]int32
+	LastError string
+}
+
+// KafkaDriver is the logging driver plugin. It tracks one logPair per
+// container that is currently being logged.
+type KafkaDriver struct {
+	mu      sync.Mutex
+	logs    map[string]*logPair
+	brokers []string
+
+	outputTopic         string
+	tag                 string
+	keyMode             string
+	compression         sarama.CompressionCodec
+	compressionLevel    int
+	consumerGroupPrefix string
+
+	serializerName     string
+	schemaRegistryURL  string
+	schemaRegistryAuth string
+
+	security SecurityConfig
+
+	readerMu sync.Mutex
+	readers  map[string]ReaderHealth
+}
+
+// NewDriver builds a KafkaDriver that ships logs to brokers, using
+// defaultTopic and defaultTag unless a container overrides them. compression
+// and compressionLevel configure the producer codec used for containers
+// that don't set ENV_COMPRESSION themselves. consumerGroupPrefix is
+// prepended to a container's ID to build its default consumer group.
+// serializerName selects the default wire format ("json", "protobuf" or
+// "avro"); schemaRegistryURL/schemaRegistryAuth configure the Confluent
+// Schema Registry used when serializerName (or a container's override) is
+// "avro". security configures the default TLS/SASL settings used to
+// authenticate to brokers.
+func NewDriver(brokers []string, defaultTopic string, defaultTag string, keyMode string, compression sarama.CompressionCodec, compressionLevel int, consumerGroupPrefix string, serializerName string, schemaRegistryURL string, schemaRegistryAuth string, security SecurityConfig) *KafkaDriver {
+	return &KafkaDriver{
+		logs:                make(map[string]*logPair),
+		brokers:             brokers,
+		outputTopic:         defaultTopic,
+		tag:                 defaultTag,
+		keyMode:             keyMode,
+		compression:         compression,
+		compressionLevel:    compressionLevel,
+		consumerGroupPrefix: consumerGroupPrefix,
+		serializerName:      serializerName,
+		schemaRegistryURL:   schemaRegistryURL,
+		schemaRegistryAuth:  schemaRegistryAuth,
+		security:            security,
+		readers:             make(map[string]ReaderHealth),
+	}
+}
+
+// StartLogging begins shipping the fifo at file to Kafka for the container
+// described by info.
+func (d *KafkaDriver) StartLogging(file string, info logger.Info) error {
+	d.mu.Lock()
+	_, exists := d.logs[file]
+	d.mu.Unlock()
+	if exists {
+		return fmt.Errorf("logging is already active for %s", file)
+	}
+
+	stream, err := fifo.OpenFifo(context.Background(), file, os.O_RDONLY, 0700)
+	if err != nil {
+		return fmt.Errorf("error opening logger fifo: %q: %v", file, err)
+	}
+
+	compression, err := getCompressionForContainer(d, info)
+	if err != nil {
+		logrus.WithError(err).WithField("container", info.ContainerID).Warn("invalid " + ENV_COMPRESSION + ", falling back to driver default")
+		compression = d.compression
+	}
+
+	producer, err := newKafkaProducer(d.brokers, compression, d.compressionLevel, securityConfigForContainer(d, info))
+	if err != nil {
+		stream.Close()
+		return err
+	}
+
+	lf := &logPair{producer: producer, stream: stream, info: info, retryDone: make(chan struct{})}
+
+	d.mu.Lock()
+	d.logs[file] = lf
+	d.mu.Unlock()
+
+	topic := getOutputTopicForContainer(d, info)
+	tag := getTagForContainer(d, info)
+
+	serializer, err := getSerializerForContainer(d, info, topic)
+	if err != nil {
+		logrus.WithError(err).WithField("container", info.ContainerID).Warn("invalid serializer config, falling back to json")
+		serializer = jsonSerializer{}
+	}
+
+	lf.retryWG.Add(1)
+	go func() {
+		defer lf.retryWG.Done()
+		handleProducerErrors(producer, defaultRetryBackoff, dlqTopicForContainer(info, topic), info, lf.retryDone, &lf.retryWG)
+	}()
+
+	go func() {
+		if err := writeLogsToKafka(lf, topic, d.keyMode, tag, serializer); err != nil {
+			logrus.WithError(err).WithField("container", info.ContainerID).Error("error writing logs to kafka")
+		}
+	}()
+
+	return nil
+}
+
+// StopLogging stops shipping the fifo at file and releases its resources.
+func (d *KafkaDriver) StopLogging(file string) error {
+	d.mu.Lock()
+	lf, exists := d.logs[file]
+	delete(d.logs, file)
+	d.mu.Unlock()
+
+	if !exists {
+		return nil
+	}
+
+	lf.stream.Close()
+
+	close(lf.retryDone)
+	lf.retryWG.Wait()
+
+	return lf.producer.Close()
+}
+
+// ReadLogs satisfies the plugin's logger.Reader interface. It joins a
+// per-container consumer group (so repeated reads resume from the last
+// committed offset rather than re-scanning the topic) and replays it back
+// to Docker as a protobuf stream.
+func (d *KafkaDriver) ReadLogs(info logger.Info, config logger.ReadConfig) (io.ReadCloser, error) {
+	clientConfig, err := readerClientConfig(securityConfigForContainer(d, info))
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sarama.NewClient(d.brokers, clientConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	groupID := getConsumerGroupIDForContainer(d, info)
+
+	group, err := sarama.NewConsumerGroupFromClient(groupID, client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	topic := getOutputTopicForContainer(d, info)
+	decoder := newLogMessageDecoder(d, info, topic)
+
+	return readLogsFromKafka(group, client, decoder, topic, info, config, func(health ReaderHealth) {
+		d.setReaderHealth(info.ContainerID, health)
+	})
+}
+
+// readerClientConfig builds the sarama.Config used for the consumer-group
+// client. A range strategy co-partitions cleanly for the common case of a
+// single consumer (one per container) in each group. Offsets.Initial is set
+// to OffsetOldest so that a fresh or overridden (ENV_CONSUMER_GROUP) group
+// replays the topic's history instead of only seeing messages produced
+// after it joins; groupReadHandler.Setup resets to a more specific offset
+// when Tail is requested. security configures the TLS/SASL settings used to
+// authenticate to the brokers.
+func readerClientConfig(security SecurityConfig) (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategyRange
+	config.Consumer.Return.Errors = true
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+
+	if err := applySecurityConfig(config, security); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// getConsumerGroupIDForContainer returns the consumer group ID to join to
+// read info's logs back, preferring the per-container ENV_CONSUMER_GROUP
+// override over the driver's default of consumerGroupPrefix+ContainerID.
+func getConsumerGroupIDForContainer(d *KafkaDriver, info logger.Info) string {
+	for _, kv := range info.ContainerEnv {
+		if strings.HasPrefix(kv, ENV_CONSUMER_GROUP+"=") {
+			return strings.TrimPrefix(kv, ENV_CONSUMER_GROUP+"=")
+		}
+	}
+
+	return d.consumerGroupPrefix + info.ContainerID
+}
+
+// ReaderHealthStatuses returns a snapshot of every container's consumer
+// group connection state, for health reporting.
+func (d *KafkaDriver) ReaderHealthStatuses() map[string]ReaderHealth {
+	d.readerMu.Lock()
+	defer d.readerMu.Unlock()
+
+	out := make(map[string]ReaderHealth, len(d.readers))
+	for containerID, health := range d.readers {
+		out[containerID] = health
+	}
+	return out
+}
+
+func (d *KafkaDriver) setReaderHealth(containerID string, health ReaderHealth) {
+	d.readerMu.Lock()
+	defer d.readerMu.Unlock()
+	d.readers[containerID] = health
+}
+
+// getTagForContainer returns the tag to use for info, preferring the
+// per-container ENV_LOG_TAG override over the driver's default.
+func getTagForContainer(d *KafkaDriver, info logger.Info) string {
+	for _, kv := range info.ContainerEnv {
+		if strings.HasPrefix(kv, ENV_LOG_TAG+"=") {
+			return strings.TrimPrefix(kv, ENV_LOG_TAG+"=")
+		}
+	}
+
+	return d.tag
+}
+
+// getOutputTopicForContainer returns the topic to publish info's logs to,
+// preferring the per-container ENV_TOPIC override over the driver's
+// default. The special values $CONTAINERNAME and $CONTAINERID expand to
+// the container's own name/ID so that each container can be routed to its
+// own topic without per-container configuration.
+func getOutputTopicForContainer(d *KafkaDriver, info logger.Info) string {
+	for _, kv := range info.ContainerEnv {
+		if !strings.HasPrefix(kv, ENV_TOPIC+"=") {
+			continue
+		}
+
+		override := strings.TrimPrefix(kv, ENV_TOPIC+"=")
+		switch override {
+		case "$CONTAINERNAME":
+			return info.ContainerName
+		case "$CONTAINERID":
+			return info.ContainerID
+		default:
+			return override
+		}
+	}
+
+	return d.outputTopic
+}
+
+// getCompressionForContainer returns the compression codec to use for
+// info, preferring the per-container ENV_COMPRESSION override over the
+// driver's default.
+func getCompressionForContainer(d *KafkaDriver, info logger.Info) (sarama.CompressionCodec, error) {
+	for _, kv := range info.ContainerEnv {
+		if strings.HasPrefix(kv, ENV_COMPRESSION+"=") {
+			return parseCompressionCodec(strings.TrimPrefix(kv, ENV_COMPRESSION+"="))
+		}
+	}
+
+	return d.compression, nil
+}
+
+// parseCompressionCodec maps the driver/container compression option
+// ("none", "gzip", "snappy", "lz4", "zstd") to a sarama.CompressionCodec.
+func parseCompressionCodec(name string) (sarama.CompressionCodec, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return sarama.CompressionNone, nil
+	case "gzip":
+		return sarama.CompressionGZIP, nil
+	case "snappy":
+		return sarama.CompressionSnappy, nil
+	case "lz4":
+		return sarama.CompressionLZ4, nil
+	case "zstd":
+		return sarama.CompressionZSTD, nil
+	default:
+		return sarama.CompressionNone, fmt.Errorf("unknown compression codec %q", name)
+	}
+}
+
+// writeLogsToKafka reads the protobuf-framed log stream off lf.stream,
+// reassembles lines that docker split into partial chunks and publishes
+// one Kafka message per logical line to topic, encoded with serializer.
+func writeLogsToKafka(lf *logPair, topic string, keyMode string, tag string, serializer Serializer) error {
+	dec := protoio.NewUint32DelimitedReader(lf.stream, binary.BigEndian, 1e6)
+	defer dec.Close()
+
+	var buf logdriver.LogEntry
+	var pending strings.Builder
+	accumulating := false
+
+	for {
+		if err := dec.ReadMsg(&buf); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		pending.Write(buf.Line)
+
+		if buf.Partial {
+			// Docker split this write across multiple chunks; keep
+			// buffering until we see the chunk that completes it.
+			accumulating = true
+			buf.Reset()
+			continue
+		}
+
+		if accumulating && !strings.HasSuffix(pending.String(), "\n") {
+			// This chunk finishes the partial sequence's buffer-size
+			// split, but the application's own write hasn't ended in a
+			// newline yet - keep waiting for the rest of the line.
+			buf.Reset()
+			continue
+		}
+		accumulating = false
+
+		msg := LogMessage{
+			Line:               pending.String(),
+			Source:             buf.Source,
+			Partial:            buf.Partial,
+			Timestamp:          time.Unix(0, buf.TimeNano),
+			ContainerId:        lf.info.ContainerID,
+			ContainerName:      lf.info.ContainerName,
+			ContainerImageId:   lf.info.ContainerImageID,
+			ContainerImageName: lf.info.ContainerImageName,
+			Hostname:           hostname(),
+			Tag:                tag,
+		}
+
+		if headersOnlyForContainer(lf.info) {
+			msg.Source = ""
+			msg.Partial = false
+			msg.ContainerId = ""
+			msg.ContainerName = ""
+			msg.ContainerImageId = ""
+			msg.ContainerImageName = ""
+			msg.Hostname = ""
+			msg.Tag = ""
+		}
+
+		payload, err := serializer.Serialize(msg)
+		if err != nil {
+			buf.Reset()
+			pending.Reset()
+			continue
+		}
+
+		producerMsg := &sarama.ProducerMessage{
+			Topic:   topic,
+			Value:   sarama.ByteEncoder(payload),
+			Headers: buildLogHeaders(lf.info, tag, buf.Source, buf.Partial, serializer.Name()),
+		}
+
+		switch keyMode {
+		case KEY_BY_CONTAINERID:
+			producerMsg.Key = sarama.StringEncoder(lf.info.ContainerID)
+		case KEY_BY_TIMESTAMP:
+			producerMsg.Key = sarama.StringEncoder(msg.Timestamp.String())
+		}
+
+		lf.producer.Input() <- producerMsg
+
+		buf.Reset()
+		pending.Reset()
+	}
+
+	return nil
+}
+
+// headersOnlyForContainer reports whether info's container was started
+// with --log-opt headers_only=true, meaning its messages carry metadata
+// only in Kafka record headers and not in the JSON body.
+func headersOnlyForContainer(info logger.Info) bool {
+	return strings.EqualFold(info.Config[headersOnlyOpt], "true")
+}
+
+// optForContainer resolves the --log-opt value of key for info, preferring
+// the per-container override over driverDefault.
+func optForContainer(info logger.Info, key string, driverDefault string) string {
+	if v, ok := info.Config[key]; ok && v != "" {
+		return v
+	}
+	return driverDefault
+}
+
+// boolOptForContainer is optForContainer for boolean --log-opt values.
+func boolOptForContainer(info logger.Info, key string, driverDefault bool) bool {
+	if v, ok := info.Config[key]; ok {
+		return strings.EqualFold(v, "true")
+	}
+	return driverDefault
+}
+
+// buildLogHeaders returns the Kafka record headers carrying info's
+// container metadata plus this message's source/partial/tag/serializer, so
+// a consumer can filter, route and decode without first parsing the body.
+func buildLogHeaders(info logger.Info, tag string, source string, partial bool, serializerName string) []sarama.RecordHeader {
+	partialValue := "false"
+	if partial {
+		partialValue = "true"
+	}
+
+	return []sarama.RecordHeader{
+		{Key: []byte(containerIDHeader), Value: []byte(info.ContainerID)},
+		{Key: []byte(containerNameHeader), Value: []byte(info.ContainerName)},
+		{Key: []byte(imageIDHeader), Value: []byte(info.ContainerImageID)},
+		{Key: []byte(imageNameHeader), Value: []byte(info.ContainerImageName)},
+		{Key: []byte(hostnameHeader), Value: []byte(hostname())},
+		{Key: []byte(sourceHeader), Value: []byte(source)},
+		{Key: []byte(partialHeader), Value: []byte(partialValue)},
+		{Key: []byte(tagHeader), Value: []byte(tag)},
+		{Key: []byte(serializerHeader), Value: []byte(serializerName)},
+	}
+}
+
+// recordHeaderValue returns the value of the header named key, if present.
+func recordHeaderValue(headers []*sarama.RecordHeader, key string) (string, bool) {
+	for _, h := range headers {
+		if string(h.Key) == key {
+			return string(h.Value), true
+		}
+	}
+	return "", false
+}
+
+// matchesContainer reports whether msg belongs to containerID, preferring
+// the container_id record header and falling back to the JSON body for
+// records written before headers were introduced.
+func matchesContainer(msg *sarama.ConsumerMessage, containerID string) bool {
+	if v, ok := recordHeaderValue(msg.Headers, containerIDHeader); ok {
+		return v == containerID
+	}
+
+	var logMsg LogMessage
+	if err := json.Unmarshal(msg.Value, &logMsg); err != nil {
+		return false
+	}
+	return logMsg.ContainerId == containerID
+}
+
+// buildLogEntry decodes msg's body (via decoder, which picks the matching
+// Serializer off serializerHeader) into a logdriver.LogEntry, filling in
+// source/partial from the record headers when the body omitted them
+// (headers_only producers).
+func buildLogEntry(msg *sarama.ConsumerMessage, decoder *logMessageDecoder) (logdriver.LogEntry, bool) {
+	logMsg, ok := decoder.decode(msg)
+	if !ok {
+		return logdriver.LogEntry{}, false
+	}
+
+	source := logMsg.Source
+	if source == "" {
+		if v, ok := recordHeaderValue(msg.Headers, sourceHeader); ok {
+			source = v
+		}
+	}
+
+	partial := logMsg.Partial
+	if v, ok := recordHeaderValue(msg.Headers, partialHeader); ok {
+		partial = v == "true"
+	}
+
+	return logdriver.LogEntry{
+		Line:     []byte(logMsg.Line + "\n"),
+		Source:   source,
+		TimeNano: logMsg.Timestamp.UnixNano(),
+		Partial:  partial,
+	}, true
+}
+
+// readLogsFromKafka replays every partition of topic, filtering for
+// messages belonging to info's container, and writes them back out as a
+// protobuf-framed logdriver.LogEntry stream for Docker to read.
+// offsetFetcher abstracts the single sarama.Client method groupReadHandler
+// needs to resolve a Tail request into a starting offset, so tests can fake
+// it without standing up a full sarama.Client.
+type offsetFetcher interface {
+	GetOffset(topic string, partitionID int32, time int64) (int64, error)
+}
+
+// groupReadHandler implements sarama.ConsumerGroupHandler, translating the
+// claimed partitions of a single container's reader group back into the
+// protobuf stream Docker expects. When tail is set, Setup resets every
+// claimed partition to (high water mark - tail) before ConsumeClaim starts
+// delivering messages, satisfying Docker's Tail=N one-shot read mode.
+type groupReadHandler struct {
+	info         logger.Info
+	tail         int
+	offsets      offsetFetcher
+	decoder      *logMessageDecoder
+	enc          protoio.WriteCloser
+	lastActivity *int64
+}
+
+func (h *groupReadHandler) Setup(session sarama.ConsumerGroupSession) error {
+	if h.tail <= 0 {
+		return nil
+	}
+
+	for topic, partitions := range session.Claims() {
+		for _, partition := range partitions {
+			hwm, err := h.offsets.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				continue
+			}
+
+			start := hwm - int64(h.tail)
+			if start < 0 {
+				start = 0
+			}
+
+			session.ResetOffset(topic, partition, start, "")
+		}
+	}
+
+	return nil
+}
+
+func (h *groupReadHandler) Cleanup(sarama.ConsumerGroupSession) error { return nil }
+
+func (h *groupReadHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		atomic.StoreInt64(h.lastActivity, time.Now().UnixNano())
+
+		if matchesContainer(msg, h.info.ContainerID) {
+			if entry, ok := buildLogEntry(msg, h.decoder); ok {
+				h.enc.WriteMsg(&entry)
+			}
+		}
+
+		session.MarkMessage(msg, "")
+	}
+
+	return nil
+}
+
+// cancelReadCloser wraps a reader so that closing it (as Docker does once
+// it's done with a log stream) tears down the consumer group session
+// backing it, instead of leaving it consuming until the process exits.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+func (c *cancelReadCloser) Close() error {
+	c.once.Do(c.cancel)
+	return c.ReadCloser.Close()
+}
+
+// readLogsFromKafka joins group under topic and streams info's messages
+// back through the returned reader. It reconnects with exponential backoff
+// if a session ends in error, reporting the resulting ReaderHealth via
+// onStatus after every session. For non-follow reads, the stream is closed
+// once no message has arrived for readIdleTimeout, since Tail/Since reads
+// have no natural end-of-data signal from Kafka.
+func readLogsFromKafka(group sarama.ConsumerGroup, offsets offsetFetcher, decoder *logMessageDecoder, topic string, info logger.Info, config logger.ReadConfig, onStatus func(ReaderHealth)) (io.ReadCloser, error) {
+	reader, writer := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	enc := protoio.NewUint32DelimitedWriter(writer, binary.BigEndian)
+	var lastActivity int64
+	atomic.StoreInt64(&lastActivity, time.Now().UnixNano())
+
+	if !config.Follow {
+		go func() {
+			ticker := time.NewTicker(readIdleTimeout / 4)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					last := time.Unix(0, atomic.LoadInt64(&lastActivity))
+					if time.Since(last) >= readIdleTimeout {
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer group.Close()
+		defer enc.Close()
+		defer writer.Close()
+
+		backoff := readerReconnectInitialBackoff
+
+		for {
+			handler := &groupReadHandler{
+				info:         info,
+				tail:         config.Tail,
+				offsets:      offsets,
+				decoder:      decoder,
+				enc:          enc,
+				lastActivity: &lastActivity,
+			}
+
+			err := group.Consume(ctx, []string{topic}, handler)
+
+			health := ReaderHealth{Connected: err == nil}
+			if err != nil {
+				health.LastError = err.Error()
+			}
+			if onStatus != nil {
+				onStatus(health)
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err != nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+
+				backoff *= 2
+				if backoff > readerReconnectMaxBackoff {
+					backoff = readerReconnectMaxBackoff
+				}
+				continue
+			}
+
+			backoff = readerReconnectInitialBackoff
+
+			if !config.Follow {
+				return
+			}
+		}
+	}()
+
+	return &cancelReadCloser{ReadCloser: reader, cancel: cancel}, nil
+}
+
+// producerConfig builds the sarama.Config shared by the real and mock
+// producer constructors, applying the given compression codec/level and
+// TLS/SASL settings.
+func producerConfig(compression sarama.CompressionCodec, compressionLevel int, security SecurityConfig) (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	config.Producer.Compression = compression
+	config.Producer.CompressionLevel = compressionLevel
+
+	if err := applySecurityConfig(config, security); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// newKafkaProducer builds the sarama.AsyncProducer used to ship log
+// messages to a real Kafka cluster.
+func newKafkaProducer(brokers []string, compression sarama.CompressionCodec, compressionLevel int, security SecurityConfig) (sarama.AsyncProducer, error) {
+	config, err := producerConfig(compression, compressionLevel, security)
+	if err != nil {
+		return nil, err
+	}
+	return sarama.NewAsyncProducer(brokers, config)
+}
+
+// NewProducer builds a mocks.AsyncProducer for use in tests, wired up the
+// same way newKafkaProducer configures a real producer.
+func NewProducer(t mocks.ErrorReporter) *mocks.AsyncProducer {
+	config, _ := producerConfig(sarama.CompressionNone, sarama.CompressionLevelDefault, SecurityConfig{})
+	return mocks.NewAsyncProducer(t, config)
+}
+
+// setLogLevel configures the package-wide logrus log level from a string
+// such as "debug" or "info".
+func setLogLevel(level string) {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		lvl = logrus.InfoLevel
+	}
+
+	logrus.SetLevel(lvl)
+}
+
+// hostname returns the local hostname, or an empty string if it can't be
+// determined.
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
+
+// unmarshallMessage decodes the JSON payload of a produced Kafka message
+// back into a LogMessage, failing t if the payload is malformed.
+func unmarshallMessage(msg *sarama.ProducerMessage, t assert.TestingT) LogMessage {
+	var out LogMessage
+
+	valueBytes, err := msg.Value.Encode()
+	assert.NoError(t, err)
+
+	err = json.Unmarshal(valueBytes, &out)
+	assert.NoError(t, err)
+
+	return out
+}
+
+// assertLineMatch asserts that msg carries expectedLine as its Line field.
+func assertLineMatch(t assert.TestingT, expectedLine string, msg *sarama.ProducerMessage) {
+	out := unmarshallMessage(msg, t)
+	assert.Equal(t, expectedLine, out.Line)
+}
@@ -1,25 +1,29 @@
 package main
 
 import (
-	"testing"
 	"bytes"
-	"github.com/docker/docker/api/types/plugins/logdriver"
-	"time"
-	"github.com/docker/docker/pkg/ioutils"
-	protoio "github.com/gogo/protobuf/io"
+	"context"
 	"encoding/binary"
-	"io"
+	"encoding/json"
+	"fmt"
+	"github.com/Shopify/sarama"
 	"github.com/Shopify/sarama/mocks"
+	"github.com/docker/docker/api/types/plugins/logdriver"
 	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/pkg/ioutils"
+	protoio "github.com/gogo/protobuf/io"
+	"github.com/hamba/avro/v2"
+	"github.com/hamba/avro/v2/registry"
 	"github.com/stretchr/testify/assert"
-	"github.com/Shopify/sarama"
+	"io"
 	"io/ioutil"
-	"encoding/json"
-	"strconv"
 	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
 )
 
-
 func TestConsumesSingleLogMessagesFromDocker(t *testing.T) {
 	producer := NewProducer(t)
 	defer producer.Close()
@@ -31,13 +35,12 @@ func TestConsumesSingleLogMessagesFromDocker(t *testing.T) {
 	lf := createLogPair(producer, stream)
 
 	producer.ExpectInputAndSucceed()
-	writeLogsToKafka(&lf, "topic", KEY_BY_TIMESTAMP, TAG)
+	writeLogsToKafka(lf, "topic", KEY_BY_TIMESTAMP, TAG, jsonSerializer{})
 
 	recvMsg := <-producer.Successes()
 	assertLineMatch(t, "alpha", recvMsg)
 }
 
-
 func TestConsumesMultipleLogMessagesFromDocker(t *testing.T) {
 	producer := NewProducer(t)
 	defer producer.Close()
@@ -55,7 +58,7 @@ func TestConsumesMultipleLogMessagesFromDocker(t *testing.T) {
 	producer.ExpectInputAndSucceed()
 	producer.ExpectInputAndSucceed()
 	producer.ExpectInputAndSucceed()
-	writeLogsToKafka(&lf, "topic", KEY_BY_TIMESTAMP, TAG)
+	writeLogsToKafka(lf, "topic", KEY_BY_TIMESTAMP, TAG, jsonSerializer{})
 
 	assertLineMatch(t, "alpha", <-producer.Successes())
 	assertLineMatch(t, "beta", <-producer.Successes())
@@ -76,7 +79,7 @@ func TestAggregatesPartialLogMessagesFromDocker(t *testing.T) {
 	lf := createLogPair(producer, stream)
 
 	producer.ExpectInputAndSucceed()
-	writeLogsToKafka(&lf, "topic", KEY_BY_TIMESTAMP, TAG)
+	writeLogsToKafka(lf, "topic", KEY_BY_TIMESTAMP, TAG, jsonSerializer{})
 
 	assertLineMatch(t, "alphabetacharlie\n", <-producer.Successes())
 }
@@ -87,7 +90,6 @@ func TestJsonIncludesContainerInformation(t *testing.T) {
 	expectedContainerImageName := "my/image"
 	expectedContainerImageID := "23293480238"
 
-
 	producer := NewProducer(t)
 	defer producer.Close()
 
@@ -101,9 +103,8 @@ func TestJsonIncludesContainerInformation(t *testing.T) {
 	lf.info.ContainerImageName = expectedContainerImageName
 	lf.info.ContainerImageID = expectedContainerImageID
 
-
 	producer.ExpectInputAndSucceed()
-	writeLogsToKafka(&lf, "topic", KEY_BY_TIMESTAMP, TAG)
+	writeLogsToKafka(lf, "topic", KEY_BY_TIMESTAMP, TAG, jsonSerializer{})
 
 	recvMsg := <-producer.Successes()
 	outMsg := unmarshallMessage(recvMsg, t)
@@ -114,7 +115,7 @@ func TestJsonIncludesContainerInformation(t *testing.T) {
 }
 
 func TestJsonIncludesHostname(t *testing.T) {
-	expectedHostname,_ := os.Hostname()
+	expectedHostname, _ := os.Hostname()
 
 	producer := NewProducer(t)
 	defer producer.Close()
@@ -126,13 +127,188 @@ func TestJsonIncludesHostname(t *testing.T) {
 	lf := createLogPair(producer, stream)
 
 	producer.ExpectInputAndSucceed()
-	writeLogsToKafka(&lf, "topic", KEY_BY_TIMESTAMP, TAG)
+	writeLogsToKafka(lf, "topic", KEY_BY_TIMESTAMP, TAG, jsonSerializer{})
 
 	recvMsg := <-producer.Successes()
 	outMsg := unmarshallMessage(recvMsg, t)
 	assert.Equal(t, expectedHostname, outMsg.Hostname)
 }
 
+func TestWriteLogsToKafkaSetsContainerMetadataHeaders(t *testing.T) {
+	expectedHostname, _ := os.Hostname()
+
+	producer := NewProducer(t)
+	defer producer.Close()
+
+	stream := createBufferForLogMessages([]logdriver.LogEntry{newLogEntry("alpha")})
+
+	lf := createLogPair(producer, stream)
+	lf.info.ContainerImageID = "image123"
+	lf.info.ContainerImageName = "my/image"
+
+	producer.ExpectInputAndSucceed()
+	writeLogsToKafka(lf, "topic", KEY_BY_TIMESTAMP, TAG, jsonSerializer{})
+
+	recvMsg := <-producer.Successes()
+
+	headers := make(map[string]string, len(recvMsg.Headers))
+	for _, h := range recvMsg.Headers {
+		headers[string(h.Key)] = string(h.Value)
+	}
+
+	assert.Equal(t, lf.info.ContainerID, headers[containerIDHeader])
+	assert.Equal(t, lf.info.ContainerName, headers[containerNameHeader])
+	assert.Equal(t, lf.info.ContainerImageID, headers[imageIDHeader])
+	assert.Equal(t, lf.info.ContainerImageName, headers[imageNameHeader])
+	assert.Equal(t, expectedHostname, headers[hostnameHeader])
+	assert.Equal(t, "container", headers[sourceHeader])
+	assert.Equal(t, "false", headers[partialHeader])
+	assert.Equal(t, TAG, headers[tagHeader])
+	assert.Equal(t, "json", headers[serializerHeader])
+}
+
+func TestHeadersOnlyOmitsRedundantJsonFields(t *testing.T) {
+	producer := NewProducer(t)
+	defer producer.Close()
+
+	stream := createBufferForLogMessages([]logdriver.LogEntry{newLogEntry("alpha")})
+
+	lf := createLogPair(producer, stream)
+	lf.info.Config = map[string]string{headersOnlyOpt: "true"}
+
+	producer.ExpectInputAndSucceed()
+	writeLogsToKafka(lf, "topic", KEY_BY_TIMESTAMP, TAG, jsonSerializer{})
+
+	recvMsg := <-producer.Successes()
+
+	valueBytes, err := recvMsg.Value.Encode()
+	assert.NoError(t, err)
+
+	var raw map[string]interface{}
+	assert.NoError(t, json.Unmarshal(valueBytes, &raw))
+
+	for _, field := range []string{"container_id", "container_name", "container_image_id", "container_image_name", "hostname", "tag", "source", "partial"} {
+		_, present := raw[field]
+		assert.False(t, present, "expected %q to be omitted from the headers_only JSON body", field)
+	}
+
+	assert.Equal(t, "alpha", raw["line"])
+}
+
+func TestProtobufSerializerRoundTrips(t *testing.T) {
+	serializer := protobufSerializer{}
+
+	msg := LogMessage{
+		Line:        "alpha",
+		Source:      "stdout",
+		Partial:     true,
+		Timestamp:   time.Unix(0, 123),
+		ContainerId: "container123",
+		Tag:         TAG,
+	}
+
+	payload, err := serializer.Serialize(msg)
+	assert.NoError(t, err)
+
+	decoded, err := serializer.Deserialize(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, decoded)
+}
+
+// fakeSchemaRegistry is an in-memory schemaRegistry, standing in for a real
+// Confluent Schema Registry so avro serializer tests don't need a live HTTP
+// endpoint.
+type fakeSchemaRegistry struct {
+	mu        sync.Mutex
+	nextID    int
+	schemas   map[int]avro.Schema
+	bySubject map[string]int
+}
+
+func newFakeSchemaRegistry() *fakeSchemaRegistry {
+	return &fakeSchemaRegistry{schemas: map[int]avro.Schema{}, bySubject: map[string]int{}}
+}
+
+func (f *fakeSchemaRegistry) IsRegistered(ctx context.Context, subject, schema string) (int, avro.Schema, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id, ok := f.bySubject[subject]
+	if !ok {
+		return 0, nil, fmt.Errorf("subject %q is not registered", subject)
+	}
+	return id, f.schemas[id], nil
+}
+
+func (f *fakeSchemaRegistry) CreateSchema(ctx context.Context, subject, schema string, refs ...registry.SchemaReference) (int, avro.Schema, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parsed, err := avro.Parse(schema)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	f.nextID++
+	f.schemas[f.nextID] = parsed
+	f.bySubject[subject] = f.nextID
+	return f.nextID, parsed, nil
+}
+
+func (f *fakeSchemaRegistry) GetSchema(ctx context.Context, id int) (avro.Schema, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	schema, ok := f.schemas[id]
+	if !ok {
+		return nil, fmt.Errorf("schema %d not found", id)
+	}
+	return schema, nil
+}
+
+func TestAvroSerializerRoundTripsThroughSchemaRegistry(t *testing.T) {
+	client := newFakeSchemaRegistry()
+	serializer := newAvroSerializer(client, "logtopic-value")
+
+	msg := LogMessage{
+		Line:        "alpha",
+		Source:      "stdout",
+		Timestamp:   time.Unix(0, 123),
+		ContainerId: "container123",
+		Tag:         TAG,
+	}
+
+	payload, err := serializer.Serialize(msg)
+	assert.NoError(t, err)
+	if assert.True(t, len(payload) > 5) {
+		assert.Equal(t, byte(0), payload[0])
+	}
+
+	decoded, err := serializer.Deserialize(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, decoded)
+
+	_, registered := client.bySubject["logtopic-value"]
+	assert.True(t, registered)
+}
+
+func TestGetSerializerForContainerPrefersPerContainerOption(t *testing.T) {
+	driver := NewDriver(nil, "topic", TAG, KEY_BY_NONE, sarama.CompressionNone, sarama.CompressionLevelDefault, "", "json", "", "", SecurityConfig{})
+
+	info := logger.Info{Config: map[string]string{serializerOpt: "protobuf"}}
+
+	serializer, err := getSerializerForContainer(driver, info, "topic")
+	assert.NoError(t, err)
+	assert.Equal(t, "protobuf", serializer.Name())
+}
+
+func TestGetSerializerForContainerAvroRequiresSchemaRegistryURL(t *testing.T) {
+	driver := NewDriver(nil, "topic", TAG, KEY_BY_NONE, sarama.CompressionNone, sarama.CompressionLevelDefault, "", "avro", "", "", SecurityConfig{})
+
+	_, err := getSerializerForContainer(driver, logger.Info{}, "topic")
+	assert.Error(t, err)
+}
+
 func TestTagCanBeOverridenWithEnvironmentVariable(t *testing.T) {
 	overrideTag := "overide"
 	defaultTag := "default"
@@ -188,7 +364,6 @@ func TestTopicIsContainerNameWhenWanted(t *testing.T) {
 	assert.Equal(t, "containera", chosenTopic)
 }
 
-
 func TestTopicIsContainerIdWhenWanted(t *testing.T) {
 	overrideTopic := "$CONTAINERID"
 	defaultTopic := "default"
@@ -203,10 +378,311 @@ func TestTopicIsContainerIdWhenWanted(t *testing.T) {
 	assert.Equal(t, "abcdef", chosenTopic)
 }
 
-func TestReadingSingleLineFromOnePartition(t *testing.T) {
-	config := sarama.NewConfig()
-	consumer := mocks.NewConsumer(t, config)
+func TestCompressionDefaultsToDriverSetting(t *testing.T) {
+	var driver KafkaDriver
+	driver.compression = sarama.CompressionGZIP
+
+	info := logger.Info{}
+
+	codec, err := getCompressionForContainer(&driver, info)
+	assert.NoError(t, err)
+	assert.Equal(t, sarama.CompressionGZIP, codec)
+}
+
+func TestCompressionCanBeOverridenWithEnvironmentVariable(t *testing.T) {
+	var driver KafkaDriver
+	driver.compression = sarama.CompressionNone
+
+	envVars := []string{ENV_COMPRESSION + "=snappy"}
+	info := logger.Info{ContainerEnv: envVars}
+
+	codec, err := getCompressionForContainer(&driver, info)
+	assert.NoError(t, err)
+	assert.Equal(t, sarama.CompressionSnappy, codec)
+}
+
+func TestCompressionOverrideRejectsUnknownCodec(t *testing.T) {
+	var driver KafkaDriver
+	driver.compression = sarama.CompressionNone
+
+	envVars := []string{ENV_COMPRESSION + "=made-up-codec"}
+	info := logger.Info{ContainerEnv: envVars}
+
+	_, err := getCompressionForContainer(&driver, info)
+	assert.Error(t, err)
+}
+
+func TestProducerConfigAppliesCompressionCodecAndLevel(t *testing.T) {
+	config, err := producerConfig(sarama.CompressionZSTD, 5, SecurityConfig{})
+	assert.NoError(t, err)
+
+	assert.Equal(t, sarama.CompressionZSTD, config.Producer.Compression)
+	assert.Equal(t, 5, config.Producer.CompressionLevel)
+}
+
+func TestProducerConfigAppliesTLSAndSASLSettings(t *testing.T) {
+	security := SecurityConfig{
+		TLSEnable:             true,
+		TLSInsecureSkipVerify: true,
+		SASLMechanism:         "PLAIN",
+		SASLUser:              "alice",
+		SASLPassword:          "secret",
+	}
+
+	config, err := producerConfig(sarama.CompressionNone, sarama.CompressionLevelDefault, security)
+	assert.NoError(t, err)
 
+	assert.True(t, config.Net.TLS.Enable)
+	assert.True(t, config.Net.TLS.Config.InsecureSkipVerify)
+	assert.True(t, config.Net.SASL.Enable)
+	assert.Equal(t, sarama.SASLMechanism("PLAIN"), config.Net.SASL.Mechanism)
+	assert.Equal(t, "alice", config.Net.SASL.User)
+	assert.Equal(t, "secret", config.Net.SASL.Password)
+}
+
+func TestProducerConfigWiresScramClientGeneratorForScramMechanisms(t *testing.T) {
+	config, err := producerConfig(sarama.CompressionNone, sarama.CompressionLevelDefault, SecurityConfig{SASLMechanism: "SCRAM-SHA-512", SASLUser: "alice", SASLPassword: "secret"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, sarama.SASLTypeSCRAMSHA512, string(config.Net.SASL.Mechanism))
+	if assert.NotNil(t, config.Net.SASL.SCRAMClientGeneratorFunc) {
+		client := config.Net.SASL.SCRAMClientGeneratorFunc()
+		assert.NoError(t, client.Begin("alice", "secret", ""))
+	}
+}
+
+func TestProducerConfigRejectsUnknownSaslMechanism(t *testing.T) {
+	_, err := producerConfig(sarama.CompressionNone, sarama.CompressionLevelDefault, SecurityConfig{SASLMechanism: "made-up"})
+	assert.Error(t, err)
+}
+
+func TestSecurityConfigForContainerPrefersPerContainerOptions(t *testing.T) {
+	var driver KafkaDriver
+	driver.security = SecurityConfig{SASLMechanism: "PLAIN", SASLUser: "driver-default"}
+
+	info := logger.Info{Config: map[string]string{
+		saslUserOpt:      "container-user",
+		tlsEnableOpt:     "true",
+		saslMechanismOpt: "SCRAM-SHA-256",
+	}}
+
+	security := securityConfigForContainer(&driver, info)
+	assert.Equal(t, "container-user", security.SASLUser)
+	assert.Equal(t, "SCRAM-SHA-256", security.SASLMechanism)
+	assert.True(t, security.TLSEnable)
+}
+
+func TestHandleProducerErrorsRetriesFailedMessagesWithBackoff(t *testing.T) {
+	producer := NewProducer(t)
+	defer producer.Close()
+
+	backoff := retryBackoff{InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, Factor: 2, MaxElapsedTime: time.Second}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	go handleProducerErrors(producer, backoff, "topic.dlq", logger.Info{ContainerID: "abc"}, done, &wg)
+
+	producer.ExpectInputAndFail(fmt.Errorf("boom"))
+	producer.ExpectInputAndSucceed()
+
+	producer.Input() <- &sarama.ProducerMessage{Topic: "topic", Value: sarama.StringEncoder("alpha")}
+
+	recvMsg := <-producer.Successes()
+	assert.Equal(t, "topic", recvMsg.Topic)
+}
+
+func TestHandleProducerErrorsWritesToDeadLetterTopicAfterExhaustingRetries(t *testing.T) {
+	producer := NewProducer(t)
+	defer producer.Close()
+
+	backoff := retryBackoff{InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, Factor: 2, MaxElapsedTime: 0}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	go handleProducerErrors(producer, backoff, "topic.dlq", logger.Info{ContainerID: "abc"}, done, &wg)
+
+	producer.ExpectInputAndFail(fmt.Errorf("boom"))
+	producer.ExpectInputAndSucceed()
+
+	producer.Input() <- &sarama.ProducerMessage{Topic: "topic", Partition: 3, Value: sarama.StringEncoder("alpha")}
+
+	dlqMsg := <-producer.Successes()
+	assert.Equal(t, "topic.dlq", dlqMsg.Topic)
+
+	headers := make(map[string]string, len(dlqMsg.Headers))
+	for _, h := range dlqMsg.Headers {
+		headers[string(h.Key)] = string(h.Value)
+	}
+
+	assert.Equal(t, "topic", headers[dlqOriginalTopicHeader])
+	assert.Equal(t, "3", headers[dlqOriginalPartitionHeader])
+	assert.Equal(t, "1", headers[dlqAttemptHeader])
+	assert.Equal(t, "boom", headers[dlqErrorHeader])
+}
+
+func TestHandleProducerErrorsDropsMessageWhenNoDlqTopicConfigured(t *testing.T) {
+	producer := NewProducer(t)
+
+	backoff := retryBackoff{InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, Factor: 2, MaxElapsedTime: 0}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	finished := make(chan struct{})
+	go func() {
+		handleProducerErrors(producer, backoff, "", logger.Info{ContainerID: "abc"}, done, &wg)
+		close(finished)
+	}()
+
+	producer.ExpectInputAndFail(fmt.Errorf("boom"))
+	producer.Input() <- &sarama.ProducerMessage{Topic: "topic", Value: sarama.StringEncoder("alpha")}
+
+	producer.Close()
+	<-finished
+}
+
+// TestHandleProducerErrorsStopsTouchingProducerOnceDoneCloses reproduces the
+// StopLogging race: a retry is still backing off (a long backoff stands in
+// for one that hasn't elapsed yet) when done is closed and retryWG is
+// waited on, exactly as StopLogging does before calling producer.Close().
+// Without the done/wg plumbing, the retry goroutine would later send on
+// producer.Input() after it's closed and panic.
+func TestHandleProducerErrorsStopsTouchingProducerOnceDoneCloses(t *testing.T) {
+	producer := NewProducer(t)
+
+	backoff := retryBackoff{InitialInterval: time.Hour, MaxInterval: time.Hour, Factor: 2, MaxElapsedTime: time.Hour}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		handleProducerErrors(producer, backoff, "topic.dlq", logger.Info{ContainerID: "abc"}, done, &wg)
+	}()
+
+	producer.ExpectInputAndFail(fmt.Errorf("boom"))
+	producer.Input() <- &sarama.ProducerMessage{Topic: "topic", Value: sarama.StringEncoder("alpha")}
+
+	// Give handleProducerErrors time to read the error and schedule the
+	// retry, which (with an hour-long backoff) is still sleeping below.
+	time.Sleep(10 * time.Millisecond)
+
+	close(done)
+	wg.Wait()
+
+	assert.NoError(t, producer.Close())
+}
+
+func TestDlqTopicForContainerDefaultsToTopicSuffix(t *testing.T) {
+	assert.Equal(t, "orders.dlq", dlqTopicForContainer(logger.Info{}, "orders"))
+
+	info := logger.Info{Config: map[string]string{dlqTopicOpt: "custom-dlq"}}
+	assert.Equal(t, "custom-dlq", dlqTopicForContainer(info, "orders"))
+}
+
+func TestReaderClientConfigDefaultsToOldestOffset(t *testing.T) {
+	config, err := readerClientConfig(SecurityConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, sarama.OffsetOldest, config.Consumer.Offsets.Initial)
+}
+
+// fakeConsumerGroup is a hand-rolled sarama.ConsumerGroup: sarama v1.27.2's
+// mocks package has no consumer-group mock, so tests drive readLogsFromKafka
+// against this instead. Messages queued for each claimed partition are
+// delivered once per Consume call, honouring any offset groupReadHandler
+// resets during Setup (used to exercise Tail).
+type fakeConsumerGroup struct {
+	claims   map[string][]int32
+	messages map[string]map[int32][]*sarama.ConsumerMessage
+}
+
+func (f *fakeConsumerGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	session := &fakeSession{ctx: ctx, claims: f.claims, resets: make(map[string]int64)}
+
+	if err := handler.Setup(session); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for topic, partitions := range f.claims {
+		for _, partition := range partitions {
+			msgs := f.messages[topic][partition]
+
+			start := int64(0)
+			if off, ok := session.resets[fmt.Sprintf("%s-%d", topic, partition)]; ok {
+				start = off
+			}
+			if start > int64(len(msgs)) {
+				start = int64(len(msgs))
+			}
+
+			claim := &fakeClaim{topic: topic, partition: partition, messages: make(chan *sarama.ConsumerMessage, len(msgs))}
+			for _, msg := range msgs[start:] {
+				claim.messages <- msg
+			}
+			close(claim.messages)
+
+			wg.Add(1)
+			go func(claim *fakeClaim) {
+				defer wg.Done()
+				handler.ConsumeClaim(session, claim)
+			}(claim)
+		}
+	}
+	wg.Wait()
+
+	return handler.Cleanup(session)
+}
+
+func (f *fakeConsumerGroup) Errors() <-chan error { return nil }
+func (f *fakeConsumerGroup) Close() error         { return nil }
+
+type fakeSession struct {
+	ctx    context.Context
+	claims map[string][]int32
+
+	mu     sync.Mutex
+	resets map[string]int64
+}
+
+func (s *fakeSession) Claims() map[string][]int32                                              { return s.claims }
+func (s *fakeSession) MemberID() string                                                        { return "fake" }
+func (s *fakeSession) GenerationID() int32                                                     { return 0 }
+func (s *fakeSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {}
+
+func (s *fakeSession) ResetOffset(topic string, partition int32, offset int64, metadata string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resets[fmt.Sprintf("%s-%d", topic, partition)] = offset
+}
+
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {}
+func (s *fakeSession) Commit()                                                  {}
+func (s *fakeSession) Context() context.Context                                 { return s.ctx }
+
+type fakeClaim struct {
+	topic     string
+	partition int32
+	messages  chan *sarama.ConsumerMessage
+}
+
+func (c *fakeClaim) Topic() string                            { return c.topic }
+func (c *fakeClaim) Partition() int32                         { return c.partition }
+func (c *fakeClaim) InitialOffset() int64                     { return 0 }
+func (c *fakeClaim) HighWaterMarkOffset() int64               { return 0 }
+func (c *fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+type fakeOffsetFetcher struct {
+	highWaterMarks map[string]map[int32]int64
+}
+
+func (f *fakeOffsetFetcher) GetOffset(topic string, partitionID int32, time int64) (int64, error) {
+	return f.highWaterMarks[topic][partitionID], nil
+}
+
+// defaultTestDecoder builds the json/protobuf-only logMessageDecoder used by
+// tests that don't exercise the avro path, which requires a Schema Registry.
+func defaultTestDecoder() *logMessageDecoder {
+	return &logMessageDecoder{json: jsonSerializer{}, protobuf: protobufSerializer{}}
+}
+
+func TestReadingSingleLineFromOnePartition(t *testing.T) {
 	expectedLine := "alpha"
 	expectedSource := "stdout"
 	expectedPartial := false
@@ -218,68 +694,64 @@ func TestReadingSingleLineFromOnePartition(t *testing.T) {
 	var logInfo logger.Info
 	logInfo.ContainerID = expectedContainerId
 
-	topics := make(map[string][]int32)
-	topics["logtopic"] = []int32{0}
-	consumer.SetTopicMetadata(topics)
-	partition := consumer.ExpectConsumePartition("logtopic", 0, sarama.OffsetOldest)
-
-	expectMessage(inputBytes, partition)
+	group := &fakeConsumerGroup{
+		claims:   map[string][]int32{"logtopic": {0}},
+		messages: map[string]map[int32][]*sarama.ConsumerMessage{"logtopic": {0: {{Value: inputBytes}}}},
+	}
 
-	partition.ExpectMessagesDrainedOnClose()
-	r, err := readLogsFromKafka(consumer, "logtopic", logInfo, logger.ReadConfig{})
+	r, err := readLogsFromKafka(group, &fakeOffsetFetcher{}, defaultTestDecoder(), "logtopic", logInfo, logger.ReadConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	dec := protoio.NewUint32DelimitedReader(r, binary.BigEndian, 1e6)
 	var outputLogMessage logdriver.LogEntry
-	err = dec.ReadMsg(&outputLogMessage)
-	if err != nil {
+	if err := dec.ReadMsg(&outputLogMessage); err != nil {
 		t.Error(err)
 	}
 
 	dec.Close()
 
 	// New line is added on output
-	assert.Equal(t, expectedLine + "\n", string(outputLogMessage.Line))
+	assert.Equal(t, expectedLine+"\n", string(outputLogMessage.Line))
 	assert.Equal(t, expectedSource, outputLogMessage.Source)
 	assert.Equal(t, expectedTime.UnixNano(), outputLogMessage.TimeNano)
 	assert.Equal(t, expectedPartial, outputLogMessage.Partial)
 }
 
-
 func TestReadingMultipleLogMessages(t *testing.T) {
-	config := sarama.NewConfig()
-	consumer := mocks.NewConsumer(t, config)
-
 	expectedSource := "stdout"
 	expectedPartial := false
 	expectedTime := time.Now()
 	expectedContainerId := "3423423"
 
-	topics := make(map[string][]int32)
-	topics["logtopic"] = []int32{0}
-	consumer.SetTopicMetadata(topics)
-	partition := consumer.ExpectConsumePartition("logtopic", 0, sarama.OffsetOldest)
-
 	numberOfMessages := 100
+	var msgs []*sarama.ConsumerMessage
 	for i := 0; i < numberOfMessages; i++ {
 		inputBytes := createLogMessage(strconv.Itoa(i), expectedSource, expectedPartial, expectedTime, expectedContainerId)
-		expectMessage(inputBytes, partition)
+		msgs = append(msgs, &sarama.ConsumerMessage{Value: inputBytes})
 	}
 
 	var logInfo logger.Info
 	logInfo.ContainerID = expectedContainerId
 
-	partition.ExpectMessagesDrainedOnClose()
-	r, err := readLogsFromKafka(consumer, "logtopic", logInfo, logger.ReadConfig{})
+	group := &fakeConsumerGroup{
+		claims:   map[string][]int32{"logtopic": {0}},
+		messages: map[string]map[int32][]*sarama.ConsumerMessage{"logtopic": {0: msgs}},
+	}
+
+	r, err := readLogsFromKafka(group, &fakeOffsetFetcher{}, defaultTestDecoder(), "logtopic", logInfo, logger.ReadConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	dec := protoio.NewUint32DelimitedReader(r, binary.BigEndian, 1e6)
 	count := 0
 	for i := 0; i < numberOfMessages; i++ {
 		var outputLogMessage logdriver.LogEntry
-		err = dec.ReadMsg(&outputLogMessage)
-		if err != nil {
+		if err := dec.ReadMsg(&outputLogMessage); err != nil {
 			t.Error(err)
 		}
-
 		count++
 	}
 
@@ -290,39 +762,46 @@ func TestReadingMultipleLogMessages(t *testing.T) {
 
 func TestTailSettingOfOne(t *testing.T) {
 	setLogLevel("debug")
-	config := sarama.NewConfig()
-	consumer := mocks.NewConsumer(t, config)
 
 	expectedSource := "stdout"
 	expectedPartial := false
 	expectedTime := time.Now()
 	expectedContainerId := "3423423"
 
-	topics := make(map[string][]int32)
-	topics["logtopic"] = []int32{0}
-	consumer.SetTopicMetadata(topics)
-
-	// This is the real assert here, that the offset is '100'
-	partition := consumer.ExpectConsumePartition("logtopic", 0, 100)
-
 	numberOfMessages := 100
+	var msgs []*sarama.ConsumerMessage
 	for i := 0; i < numberOfMessages; i++ {
 		inputBytes := createLogMessage(strconv.Itoa(i), expectedSource, expectedPartial, expectedTime, expectedContainerId)
-		expectMessage(inputBytes, partition)
+		msgs = append(msgs, &sarama.ConsumerMessage{Value: inputBytes})
 	}
-	partition.ExpectMessagesDrainedOnClose()
 
 	var logInfo logger.Info
 	logInfo.ContainerID = expectedContainerId
 
-	readLogsFromKafka(consumer, "logtopic", logInfo, logger.ReadConfig{Tail: 1})
-}
+	group := &fakeConsumerGroup{
+		claims:   map[string][]int32{"logtopic": {0}},
+		messages: map[string]map[int32][]*sarama.ConsumerMessage{"logtopic": {0: msgs}},
+	}
+	// The real assert here is that Setup resets the partition to (high
+	// water mark - tail), so only the very last message is delivered.
+	offsets := &fakeOffsetFetcher{highWaterMarks: map[string]map[int32]int64{"logtopic": {0: int64(numberOfMessages)}}}
 
-func TestReadingSingleLineFromMultiplePartitions(t *testing.T) {
-	config := sarama.NewConfig()
-	consumer := mocks.NewConsumer(t, config)
+	r, err := readLogsFromKafka(group, offsets, defaultTestDecoder(), "logtopic", logInfo, logger.ReadConfig{Tail: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
+	dec := protoio.NewUint32DelimitedReader(r, binary.BigEndian, 1e6)
+	var outputLogMessage logdriver.LogEntry
+	if err := dec.ReadMsg(&outputLogMessage); err != nil {
+		t.Error(err)
+	}
+	dec.Close()
 
+	assert.Equal(t, strconv.Itoa(numberOfMessages-1)+"\n", string(outputLogMessage.Line))
+}
+
+func TestReadingSingleLineFromMultiplePartitions(t *testing.T) {
 	expectedSource := "stdout"
 	expectedPartial := false
 	expectedTime := time.Now()
@@ -330,29 +809,32 @@ func TestReadingSingleLineFromMultiplePartitions(t *testing.T) {
 
 	var logInfo logger.Info
 	logInfo.ContainerID = expectedContainerId
-	topics := make(map[string][]int32)
-	topics["logtopic"] = []int32{1,2,3,4,5}
-	consumer.SetTopicMetadata(topics)
 
-	for _,r := range topics["logtopic"] {
-		msg := createLogMessage(strconv.Itoa(int(r)), expectedSource, expectedPartial, expectedTime, expectedContainerId)
-		partition := consumer.ExpectConsumePartition("logtopic", r, sarama.OffsetOldest)
-		expectMessage(msg, partition)
+	partitions := []int32{1, 2, 3, 4, 5}
+	byPartition := make(map[int32][]*sarama.ConsumerMessage)
+	for _, p := range partitions {
+		msg := createLogMessage(strconv.Itoa(int(p)), expectedSource, expectedPartial, expectedTime, expectedContainerId)
+		byPartition[p] = []*sarama.ConsumerMessage{{Value: msg}}
+	}
 
+	group := &fakeConsumerGroup{
+		claims:   map[string][]int32{"logtopic": partitions},
+		messages: map[string]map[int32][]*sarama.ConsumerMessage{"logtopic": byPartition},
 	}
 
-	r, err := readLogsFromKafka(consumer, "logtopic", logInfo, logger.ReadConfig{})
+	r, err := readLogsFromKafka(group, &fakeOffsetFetcher{}, defaultTestDecoder(), "logtopic", logInfo, logger.ReadConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	expectedMessageCount := len(topics["logtopic"])
+	expectedMessageCount := len(partitions)
 
-	//byteWrapper := bytes.NewReader(outputBytes)
 	dec := protoio.NewUint32DelimitedReader(r, binary.BigEndian, 1e6)
 
 	count := 0
-	for i := 0 ; i < len(topics["logtopic"]); i++ {
+	for i := 0; i < expectedMessageCount; i++ {
 		var outputLogMessage logdriver.LogEntry
-		err = dec.ReadMsg(&outputLogMessage)
-		if err != nil {
+		if err := dec.ReadMsg(&outputLogMessage); err != nil {
 			t.Error(err)
 		}
 		count++
@@ -364,12 +846,8 @@ func TestReadingSingleLineFromMultiplePartitions(t *testing.T) {
 }
 
 func TestReadingDoesNotOutputLogsForOtherContainer(t *testing.T) {
-	config := sarama.NewConfig()
-	consumer := mocks.NewConsumer(t, config)
-
 	differentContainerId := "not_the_container_we_want"
 
-
 	expectedLine := "alpha"
 	expectedSource := "stdout"
 	expectedPartial := false
@@ -381,18 +859,15 @@ func TestReadingDoesNotOutputLogsForOtherContainer(t *testing.T) {
 	var logInfo logger.Info
 	logInfo.ContainerID = differentContainerId
 
-	topics := make(map[string][]int32)
-	topics["logtopic"] = []int32{0}
-	consumer.SetTopicMetadata(topics)
-	partition := consumer.ExpectConsumePartition("logtopic", 0, sarama.OffsetOldest)
-
-	expectMessage(inputBytes, partition)
-
-	partition.ExpectMessagesDrainedOnClose()
-	r, err := readLogsFromKafka(consumer, "logtopic", logInfo, logger.ReadConfig{})
+	group := &fakeConsumerGroup{
+		claims:   map[string][]int32{"logtopic": {0}},
+		messages: map[string]map[int32][]*sarama.ConsumerMessage{"logtopic": {0: {{Value: inputBytes}}}},
+	}
 
-	// Wait a few seconds for the go threads to run
-	time.Sleep(3 * time.Second)
+	r, err := readLogsFromKafka(group, &fakeOffsetFetcher{}, defaultTestDecoder(), "logtopic", logInfo, logger.ReadConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	outputBytes, err := ioutil.ReadAll(r)
 	if err != nil {
@@ -402,12 +877,172 @@ func TestReadingDoesNotOutputLogsForOtherContainer(t *testing.T) {
 	assert.Equal(t, 0, len(outputBytes))
 }
 
-func expectMessage(inputBytes []byte, partition *mocks.PartitionConsumer) {
-	var outputMsg sarama.ConsumerMessage
-	outputMsg.Value = inputBytes
-	partition.YieldMessage(&outputMsg)
+func TestReadingFiltersOnContainerIdHeaderWhenPresent(t *testing.T) {
+	expectedContainerId := "3423423"
+
+	var logInfo logger.Info
+	logInfo.ContainerID = expectedContainerId
+
+	// headers_only records carry no container_id in the JSON body at all,
+	// so a reader that only looked at the body would drop every message.
+	wanted := &sarama.ConsumerMessage{
+		Value:   []byte(`{"line":"alpha"}`),
+		Headers: []*sarama.RecordHeader{{Key: []byte(containerIDHeader), Value: []byte(expectedContainerId)}},
+	}
+	other := &sarama.ConsumerMessage{
+		Value:   []byte(`{"line":"beta"}`),
+		Headers: []*sarama.RecordHeader{{Key: []byte(containerIDHeader), Value: []byte("some_other_container")}},
+	}
+
+	group := &fakeConsumerGroup{
+		claims:   map[string][]int32{"logtopic": {0}},
+		messages: map[string]map[int32][]*sarama.ConsumerMessage{"logtopic": {0: {wanted, other}}},
+	}
+
+	r, err := readLogsFromKafka(group, &fakeOffsetFetcher{}, defaultTestDecoder(), "logtopic", logInfo, logger.ReadConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec := protoio.NewUint32DelimitedReader(r, binary.BigEndian, 1e6)
+	var outputLogMessage logdriver.LogEntry
+	if err := dec.ReadMsg(&outputLogMessage); err != nil {
+		t.Error(err)
+	}
+	dec.Close()
+
+	assert.Equal(t, "alpha\n", string(outputLogMessage.Line))
+}
+
+func TestReadingDecodesProtobufMessagesViaSerializerHeader(t *testing.T) {
+	expectedContainerId := "3423423"
+
+	var logInfo logger.Info
+	logInfo.ContainerID = expectedContainerId
+
+	payload, err := (protobufSerializer{}).Serialize(LogMessage{Line: "alpha", Source: "stdout", ContainerId: expectedContainerId})
+	assert.NoError(t, err)
+
+	msg := &sarama.ConsumerMessage{
+		Value: payload,
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte(containerIDHeader), Value: []byte(expectedContainerId)},
+			{Key: []byte(serializerHeader), Value: []byte("protobuf")},
+		},
+	}
+
+	group := &fakeConsumerGroup{
+		claims:   map[string][]int32{"logtopic": {0}},
+		messages: map[string]map[int32][]*sarama.ConsumerMessage{"logtopic": {0: {msg}}},
+	}
+
+	r, err := readLogsFromKafka(group, &fakeOffsetFetcher{}, defaultTestDecoder(), "logtopic", logInfo, logger.ReadConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec := protoio.NewUint32DelimitedReader(r, binary.BigEndian, 1e6)
+	var outputLogMessage logdriver.LogEntry
+	if err := dec.ReadMsg(&outputLogMessage); err != nil {
+		t.Error(err)
+	}
+	dec.Close()
+
+	assert.Equal(t, "alpha\n", string(outputLogMessage.Line))
+	assert.Equal(t, "stdout", outputLogMessage.Source)
+}
+
+func TestReaderReconnectsWithBackoffAfterSessionError(t *testing.T) {
+	expectedContainerId := "3423423"
+	var logInfo logger.Info
+	logInfo.ContainerID = expectedContainerId
+
+	group := &failThenSucceedConsumerGroup{failuresRemaining: 2}
+
+	var statuses []ReaderHealth
+	var statusMu sync.Mutex
+	onStatus := func(health ReaderHealth) {
+		statusMu.Lock()
+		defer statusMu.Unlock()
+		statuses = append(statuses, health)
+	}
+
+	start := time.Now()
+	// Follow keeps the stream open (no idle-timeout goroutine racing the
+	// backoff below) until the successful session is explicitly closed.
+	r, err := readLogsFromKafka(group, &fakeOffsetFetcher{}, defaultTestDecoder(), "logtopic", logInfo, logger.ReadConfig{Follow: true}, onStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		ioutil.ReadAll(r)
+		close(drained)
+	}()
+
+	// Both failures and their backoff sleeps (250ms + 500ms) should have
+	// elapsed by now, leaving the third, successful session blocked on the
+	// fake waiting to be closed.
+	time.Sleep(900 * time.Millisecond)
+
+	assert.True(t, time.Since(start) >= 2*readerReconnectInitialBackoff, "expected reconnect backoff to be applied")
+
+	r.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		statusMu.Lock()
+		n := len(statuses)
+		statusMu.Unlock()
+		if n >= 3 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	<-drained
+
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	if assert.True(t, len(statuses) >= 3) {
+		assert.False(t, statuses[0].Connected)
+		assert.False(t, statuses[1].Connected)
+		assert.True(t, statuses[len(statuses)-1].Connected)
+	}
+}
+
+// failThenSucceedConsumerGroup fails the first failuresRemaining calls to
+// Consume, then succeeds with an empty, immediately-drained session, to
+// exercise readLogsFromKafka's reconnect-backoff loop.
+type failThenSucceedConsumerGroup struct {
+	mu                sync.Mutex
+	failuresRemaining int
 }
 
+func (f *failThenSucceedConsumerGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	f.mu.Lock()
+	if f.failuresRemaining > 0 {
+		f.failuresRemaining--
+		f.mu.Unlock()
+		return fmt.Errorf("simulated broker disconnect")
+	}
+	f.mu.Unlock()
+
+	session := &fakeSession{ctx: ctx, claims: map[string][]int32{}, resets: make(map[string]int64)}
+	if err := handler.Setup(session); err != nil {
+		return err
+	}
+
+	// A real, healthy consumer group session keeps running until its
+	// context is cancelled; block the same way so callers can observe the
+	// "connected" state before the caller decides to stop reading.
+	<-ctx.Done()
+
+	return handler.Cleanup(session)
+}
+
+func (f *failThenSucceedConsumerGroup) Errors() <-chan error { return nil }
+func (f *failThenSucceedConsumerGroup) Close() error         { return nil }
 
 func createLogMessage(expectedLine string, expectedSource string, expectedPartial bool, expectedTime time.Time, expectedContainerId string) []byte {
 	var inputMessage LogMessage
@@ -420,28 +1055,26 @@ func createLogMessage(expectedLine string, expectedSource string, expectedPartia
 	return inputBytes
 }
 
-
-func createLogPair(producer *mocks.AsyncProducer, stream io.ReadCloser) logPair {
-	var lf logPair
+func createLogPair(producer *mocks.AsyncProducer, stream io.ReadCloser) *logPair {
+	lf := &logPair{}
 	lf.producer = producer
 	lf.stream = stream
 	lf.info = logger.Info{ContainerName: "mycontainer", ContainerID: "abcdefg"}
 	return lf
 }
 
-
 func createBufferForLogMessages(logs []logdriver.LogEntry) io.ReadCloser {
 	var buf bytes.Buffer
 
 	protoWriter := protoio.NewUint32DelimitedWriter(&buf, binary.BigEndian)
 
-	for _,log := range logs {
+	for _, log := range logs {
 		protoWriter.WriteMsg(&log)
 	}
 
 	protoWriter.Close()
 
-	closeFunc := func () error {
+	closeFunc := func() error {
 		return nil
 	}
 
@@ -449,7 +1082,6 @@ func createBufferForLogMessages(logs []logdriver.LogEntry) io.ReadCloser {
 	return readCloser
 }
 
-
 func newLogEntry(line string) logdriver.LogEntry {
 	var le logdriver.LogEntry
 	le.Line = []byte(line)
@@ -464,4 +1096,3 @@ func newPartialLogEntry(line string) logdriver.LogEntry {
 	le.Partial = true
 	return le
 }
-
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/go-plugins-helpers/sdk"
+)
+
+const (
+	socketAddress = "/run/docker/plugins/kafka-log-driver.sock"
+
+	envBrokers             = "KAFKA_BROKER_ADDR"
+	envDefaultTag          = "TAG"
+	envKeyMode             = "KEY_MODE"
+	envLogLevel            = "LOG_LEVEL"
+	envCompression         = "KAFKA_COMPRESSION"
+	envCompressionLevel    = "KAFKA_COMPRESSION_LEVEL"
+	envConsumerGroupPrefix = "KAFKA_CONSUMER_GROUP_PREFIX"
+	envSerializer          = "KAFKA_SERIALIZER"
+	envSchemaRegistryURL   = "KAFKA_SCHEMA_REGISTRY_URL"
+	envSchemaRegistryAuth  = "KAFKA_SCHEMA_REGISTRY_AUTH"
+
+	envTLSEnable             = "KAFKA_TLS_ENABLE"
+	envTLSCA                 = "KAFKA_TLS_CA"
+	envTLSCert               = "KAFKA_TLS_CERT"
+	envTLSKey                = "KAFKA_TLS_KEY"
+	envTLSInsecureSkipVerify = "KAFKA_TLS_INSECURE_SKIP_VERIFY"
+	envSASLMechanism         = "KAFKA_SASL_MECHANISM"
+	envSASLUser              = "KAFKA_SASL_USER"
+	envSASLPassword          = "KAFKA_SASL_PASSWORD"
+)
+
+// startLoggingRequest/stopLoggingRequest/readLogsRequest/response mirror
+// the wire format dockerd's logger plugin client uses to talk to a
+// LoggingDriver plugin over the plugin socket.
+type startLoggingRequest struct {
+	File string
+	Info logger.Info
+}
+
+type stopLoggingRequest struct {
+	File string
+}
+
+type readLogsRequest struct {
+	Info   logger.Info
+	Config logger.ReadConfig
+}
+
+type response struct {
+	Err string
+}
+
+type capabilitiesResponse struct {
+	Cap logger.Capability
+}
+
+func main() {
+	setLogLevel(os.Getenv(envLogLevel))
+
+	brokers := strings.Split(os.Getenv(envBrokers), ",")
+
+	defaultTopic := os.Getenv(ENV_TOPIC)
+	if defaultTopic == "" {
+		defaultTopic = "docker"
+	}
+
+	defaultTag := os.Getenv(envDefaultTag)
+	if defaultTag == "" {
+		defaultTag = TAG
+	}
+
+	keyMode := os.Getenv(envKeyMode)
+	if keyMode == "" {
+		keyMode = KEY_BY_NONE
+	}
+
+	compression, err := parseCompressionCodec(os.Getenv(envCompression))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		compression = sarama.CompressionNone
+	}
+
+	compressionLevel := sarama.CompressionLevelDefault
+	if lvl := os.Getenv(envCompressionLevel); lvl != "" {
+		parsed, err := strconv.Atoi(lvl)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			compressionLevel = parsed
+		}
+	}
+
+	consumerGroupPrefix := os.Getenv(envConsumerGroupPrefix)
+
+	serializerName := os.Getenv(envSerializer)
+	schemaRegistryURL := os.Getenv(envSchemaRegistryURL)
+	schemaRegistryAuth := os.Getenv(envSchemaRegistryAuth)
+
+	security := SecurityConfig{
+		TLSEnable:             strings.EqualFold(os.Getenv(envTLSEnable), "true"),
+		TLSCA:                 os.Getenv(envTLSCA),
+		TLSCert:               os.Getenv(envTLSCert),
+		TLSKey:                os.Getenv(envTLSKey),
+		TLSInsecureSkipVerify: strings.EqualFold(os.Getenv(envTLSInsecureSkipVerify), "true"),
+		SASLMechanism:         os.Getenv(envSASLMechanism),
+		SASLUser:              os.Getenv(envSASLUser),
+		SASLPassword:          os.Getenv(envSASLPassword),
+	}
+
+	driver := NewDriver(brokers, defaultTopic, defaultTag, keyMode, compression, compressionLevel, consumerGroupPrefix, serializerName, schemaRegistryURL, schemaRegistryAuth, security)
+
+	h := sdk.NewHandler(`{"Implements": ["LoggingDriver"]}`)
+	handlers(&h, driver)
+
+	if err := h.ServeUnix(socketAddress, 0); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func handlers(h *sdk.Handler, driver *KafkaDriver) {
+	h.HandleFunc("/LogDriver.StartLogging", func(w http.ResponseWriter, r *http.Request) {
+		var req startLoggingRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondErr(w, err)
+			return
+		}
+
+		respondErr(w, driver.StartLogging(req.File, req.Info))
+	})
+
+	h.HandleFunc("/LogDriver.StopLogging", func(w http.ResponseWriter, r *http.Request) {
+		var req stopLoggingRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondErr(w, err)
+			return
+		}
+
+		respondErr(w, driver.StopLogging(req.File))
+	})
+
+	h.HandleFunc("/LogDriver.Capabilities", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&capabilitiesResponse{Cap: logger.Capability{ReadLogs: true}})
+	})
+
+	h.HandleFunc("/LogDriver.ReadLogs", func(w http.ResponseWriter, r *http.Request) {
+		var req readLogsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondErr(w, err)
+			return
+		}
+
+		stream, err := driver.ReadLogs(req.Info, req.Config)
+		if err != nil {
+			respondErr(w, err)
+			return
+		}
+		defer stream.Close()
+
+		w.Header().Set("Content-Type", "application/x-json-stream")
+		io.Copy(w, stream)
+	})
+}
+
+func respondErr(w http.ResponseWriter, err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		json.NewEncoder(w).Encode(&response{Err: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&response{})
+}
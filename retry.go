@@ -0,0 +1,186 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/sirupsen/logrus"
+)
+
+// dlqTopicOpt is the --log-opt key overriding the dead-letter topic that a
+// message is published to once it has exhausted retries. Defaults to the
+// container's output topic with a ".dlq" suffix.
+const dlqTopicOpt = "dlq_topic"
+
+// Kafka record headers recording why a message ended up on the dead-letter
+// topic, so it can be triaged without needing the driver's logs.
+const (
+	dlqOriginalTopicHeader     = "dlq_original_topic"
+	dlqOriginalPartitionHeader = "dlq_original_partition"
+	dlqAttemptHeader           = "dlq_attempt"
+	dlqErrorHeader             = "dlq_error"
+)
+
+// retryBackoff configures the delay between retries of a failed produce,
+// modelled on goka's simpleBackoff: the delay doubles (scaled by Factor)
+// from InitialInterval up to MaxInterval on every attempt, and retries stop
+// once MaxElapsedTime has passed since the message first failed.
+type retryBackoff struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Factor          float64
+	MaxElapsedTime  time.Duration
+}
+
+// defaultRetryBackoff is used to retry every failed produce; it isn't
+// currently exposed as a driver option.
+var defaultRetryBackoff = retryBackoff{
+	InitialInterval: 500 * time.Millisecond,
+	MaxInterval:     30 * time.Second,
+	Factor:          2.0,
+	MaxElapsedTime:  5 * time.Minute,
+}
+
+// delay returns how long to wait before retry attempt (1-based).
+func (b retryBackoff) delay(attempt int) time.Duration {
+	d := float64(b.InitialInterval)
+	for i := 1; i < attempt; i++ {
+		d *= b.Factor
+		if d >= float64(b.MaxInterval) {
+			return b.MaxInterval
+		}
+	}
+	return time.Duration(d)
+}
+
+// retryMetadata is stashed on a sarama.ProducerMessage's Metadata field so
+// that if it reappears on the producer's Errors() channel, handleProducerErrors
+// knows how many times it's been attempted and since when.
+type retryMetadata struct {
+	attempt      int
+	firstFailure time.Time
+}
+
+// dlqTopicForContainer returns the dead-letter topic to use for info,
+// preferring the per-container dlqTopicOpt override over topic+".dlq".
+func dlqTopicForContainer(info logger.Info, topic string) string {
+	return optForContainer(info, dlqTopicOpt, topic+".dlq")
+}
+
+// handleProducerErrors drains producer's Errors() channel, retrying failed
+// messages with backoff and routing them to dlqTopic once
+// backoff.MaxElapsedTime has elapsed since the message first failed. done is
+// closed by StopLogging before producer.Close() is called; handleProducerErrors
+// and every retry it spawns select on done before touching producer.Input(),
+// since writing to Input() after the producer is closed panics. wg must be
+// the logPair's retryWG: the caller registers this goroutine on it before
+// spawning it, and handleProducerErrors registers every retry goroutine it
+// spawns in turn, so StopLogging can wait for all of them to stop touching
+// producer.Input() before closing it.
+func handleProducerErrors(producer sarama.AsyncProducer, backoff retryBackoff, dlqTopic string, info logger.Info, done <-chan struct{}, wg *sync.WaitGroup) {
+	var retries, dlqWrites, drops int64
+
+	for {
+		var prodErr *sarama.ProducerError
+		var ok bool
+
+		select {
+		case <-done:
+			return
+		case prodErr, ok = <-producer.Errors():
+			if !ok {
+				return
+			}
+		}
+
+		msg := prodErr.Msg
+
+		if dlqTopic != "" && msg.Topic == dlqTopic {
+			drops++
+			logrus.WithError(prodErr.Err).WithField("container", info.ContainerID).WithField("topic", msg.Topic).
+				WithField("drops", drops).Error("dropping log message that failed producing to the dead-letter topic")
+			continue
+		}
+
+		meta, _ := msg.Metadata.(retryMetadata)
+		if meta.firstFailure.IsZero() {
+			meta.firstFailure = time.Now()
+		}
+		meta.attempt++
+		msg.Metadata = meta
+
+		logEntry := logrus.WithError(prodErr.Err).
+			WithField("container", info.ContainerID).
+			WithField("topic", msg.Topic).
+			WithField("attempt", meta.attempt)
+
+		if time.Since(meta.firstFailure) < backoff.MaxElapsedTime {
+			retries++
+			logEntry.WithField("retries", retries).Warn("retrying log message after kafka produce error")
+			wg.Add(1)
+			go retryAfterBackoff(producer, msg, backoff.delay(meta.attempt), done, wg)
+			continue
+		}
+
+		dlqMsg := buildDeadLetterMessage(msg, prodErr.Err, meta, dlqTopic)
+		if dlqMsg == nil {
+			drops++
+			logEntry.WithField("drops", drops).Error("dropping log message after exhausting retries, no dlq_topic configured")
+			continue
+		}
+
+		dlqWrites++
+		logEntry.WithField("dlq_writes", dlqWrites).WithField("dlq_topic", dlqTopic).
+			Error("exhausted retries producing log message, writing to dead-letter topic")
+
+		select {
+		case producer.Input() <- dlqMsg:
+		case <-done:
+		}
+	}
+}
+
+// retryAfterBackoff resubmits msg to producer once delay has elapsed,
+// unless done fires first (the container is being stopped).
+func retryAfterBackoff(producer sarama.AsyncProducer, msg *sarama.ProducerMessage, delay time.Duration, done <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	select {
+	case <-time.After(delay):
+	case <-done:
+		return
+	}
+
+	select {
+	case producer.Input() <- msg:
+	case <-done:
+	}
+}
+
+// buildDeadLetterMessage builds the message to publish to dlqTopic in place
+// of msg, carrying cause and meta as headers alongside msg's original
+// headers. It returns nil if no dlqTopic is configured, meaning msg should
+// be dropped instead.
+func buildDeadLetterMessage(msg *sarama.ProducerMessage, cause error, meta retryMetadata, dlqTopic string) *sarama.ProducerMessage {
+	if dlqTopic == "" {
+		return nil
+	}
+
+	headers := append([]sarama.RecordHeader{}, msg.Headers...)
+	headers = append(headers,
+		sarama.RecordHeader{Key: []byte(dlqOriginalTopicHeader), Value: []byte(msg.Topic)},
+		sarama.RecordHeader{Key: []byte(dlqOriginalPartitionHeader), Value: []byte(strconv.Itoa(int(msg.Partition)))},
+		sarama.RecordHeader{Key: []byte(dlqAttemptHeader), Value: []byte(strconv.Itoa(meta.attempt))},
+		sarama.RecordHeader{Key: []byte(dlqErrorHeader), Value: []byte(cause.Error())},
+	)
+
+	return &sarama.ProducerMessage{
+		Topic:   dlqTopic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/xdg/scram"
+)
+
+// Driver options configuring TLS and SASL authentication against the Kafka
+// cluster, resolved per-container the same way serializerOpt is.
+const (
+	tlsEnableOpt             = "tls_enable"
+	tlsCAOpt                 = "tls_ca"
+	tlsCertOpt               = "tls_cert"
+	tlsKeyOpt                = "tls_key"
+	tlsInsecureSkipVerifyOpt = "tls_insecure_skip_verify"
+	saslMechanismOpt         = "sasl_mechanism"
+	saslUserOpt              = "sasl_user"
+	saslPasswordOpt          = "sasl_password"
+)
+
+// SecurityConfig bundles the TLS and SASL settings used to authenticate to
+// the Kafka cluster, for both the producer and the consumer-group reader.
+type SecurityConfig struct {
+	TLSEnable             bool
+	TLSCA                 string
+	TLSCert               string
+	TLSKey                string
+	TLSInsecureSkipVerify bool
+
+	// SASLMechanism is one of "PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512" or
+	// "OAUTHBEARER". An empty value disables SASL.
+	SASLMechanism string
+	SASLUser      string
+	// SASLPassword is the SASL password for PLAIN/SCRAM mechanisms. For
+	// OAUTHBEARER, it's instead run as a shell command whose trimmed
+	// stdout is used as the bearer token, so operators can point it at a
+	// cloud provider's token helper instead of a static secret.
+	SASLPassword string
+}
+
+// securityConfigForContainer resolves the TLS/SASL settings to use for
+// info, preferring the per-container driver options over d's defaults.
+func securityConfigForContainer(d *KafkaDriver, info logger.Info) SecurityConfig {
+	return SecurityConfig{
+		TLSEnable:             boolOptForContainer(info, tlsEnableOpt, d.security.TLSEnable),
+		TLSCA:                 optForContainer(info, tlsCAOpt, d.security.TLSCA),
+		TLSCert:               optForContainer(info, tlsCertOpt, d.security.TLSCert),
+		TLSKey:                optForContainer(info, tlsKeyOpt, d.security.TLSKey),
+		TLSInsecureSkipVerify: boolOptForContainer(info, tlsInsecureSkipVerifyOpt, d.security.TLSInsecureSkipVerify),
+		SASLMechanism:         optForContainer(info, saslMechanismOpt, d.security.SASLMechanism),
+		SASLUser:              optForContainer(info, saslUserOpt, d.security.SASLUser),
+		SASLPassword:          optForContainer(info, saslPasswordOpt, d.security.SASLPassword),
+	}
+}
+
+// applySecurityConfig wires sec into cfg's Net.TLS and Net.SASL settings.
+func applySecurityConfig(cfg *sarama.Config, sec SecurityConfig) error {
+	if sec.TLSEnable {
+		tlsConfig, err := buildTLSConfig(sec)
+		if err != nil {
+			return err
+		}
+		cfg.Net.TLS.Enable = true
+		cfg.Net.TLS.Config = tlsConfig
+	}
+
+	if sec.SASLMechanism == "" {
+		return nil
+	}
+
+	cfg.Net.SASL.Enable = true
+	cfg.Net.SASL.User = sec.SASLUser
+	cfg.Net.SASL.Password = sec.SASLPassword
+
+	switch strings.ToUpper(sec.SASLMechanism) {
+	case sarama.SASLTypePlaintext:
+		cfg.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case sarama.SASLTypeSCRAMSHA256:
+		cfg.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		cfg.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &XDGSCRAMClient{HashGeneratorFcn: sha256.New}
+		}
+	case sarama.SASLTypeSCRAMSHA512:
+		cfg.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		cfg.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &XDGSCRAMClient{HashGeneratorFcn: sha512.New}
+		}
+	case sarama.SASLTypeOAuth:
+		cfg.Net.SASL.Mechanism = sarama.SASLTypeOAuth
+		cfg.Net.SASL.TokenProvider = &oauthTokenProvider{command: sec.SASLPassword}
+	default:
+		return fmt.Errorf("unknown sasl_mechanism %q", sec.SASLMechanism)
+	}
+
+	return nil
+}
+
+// buildTLSConfig builds the tls.Config used for the broker connection,
+// loading the CA/client certificate files named by sec.
+func buildTLSConfig(sec SecurityConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: sec.TLSInsecureSkipVerify}
+
+	if sec.TLSCA != "" {
+		ca, err := ioutil.ReadFile(sec.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("reading tls_ca: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("tls_ca %q contains no valid certificates", sec.TLSCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if sec.TLSCert != "" || sec.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(sec.TLSCert, sec.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading tls_cert/tls_key: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// oauthTokenProvider implements sarama.AccessTokenProvider for
+// SASL/OAUTHBEARER by running command as a shell command and using its
+// trimmed stdout as the token.
+type oauthTokenProvider struct {
+	command string
+}
+
+func (p *oauthTokenProvider) Token() (*sarama.AccessToken, error) {
+	out, err := exec.Command("sh", "-c", p.command).Output()
+	if err != nil {
+		return nil, fmt.Errorf("running sasl_password token command: %w", err)
+	}
+	return &sarama.AccessToken{Token: strings.TrimSpace(string(out))}, nil
+}
+
+// XDGSCRAMClient adapts github.com/xdg/scram's client to sarama.SCRAMClient,
+// the shape sarama's SCRAM-SHA-256/SCRAM-SHA-512 mechanisms require.
+type XDGSCRAMClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func (c *XDGSCRAMClient) Begin(userName, password, authzID string) error {
+	client, err := c.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.Client = client
+	c.ClientConversation = c.Client.NewConversation()
+	return nil
+}
+
+func (c *XDGSCRAMClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+func (c *XDGSCRAMClient) Done() bool {
+	return c.ClientConversation.Done()
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/gogo/protobuf/proto"
+	"github.com/hamba/avro/v2"
+	"github.com/hamba/avro/v2/registry"
+)
+
+// serializerHeader names the Kafka record header recording which Serializer
+// encoded a message, so the reader can pick the matching one back off.
+// Records written before this feature existed carry no such header and are
+// always assumed to be JSON.
+const serializerHeader = "serializer"
+
+// Driver options selecting a non-default serializer and, for avro, the
+// Confluent Schema Registry to register/fetch schemas against.
+const (
+	serializerOpt         = "serializer"
+	schemaRegistryURLOpt  = "schema_registry_url"
+	schemaRegistryAuthOpt = "schema_registry_auth"
+	defaultSerializerName = "json"
+)
+
+// Serializer converts a LogMessage to and from its Kafka wire representation.
+// Name identifies the format on the wire via serializerHeader, so the reader
+// can decode each message with the serializer that produced it.
+type Serializer interface {
+	Name() string
+	Serialize(msg LogMessage) ([]byte, error)
+	Deserialize(data []byte) (LogMessage, error)
+}
+
+// jsonSerializer is the driver's original, and still default, wire format.
+type jsonSerializer struct{}
+
+func (jsonSerializer) Name() string { return "json" }
+
+func (jsonSerializer) Serialize(msg LogMessage) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonSerializer) Deserialize(data []byte) (LogMessage, error) {
+	var msg LogMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return LogMessage{}, err
+	}
+	return msg, nil
+}
+
+// logMessageProto mirrors LogMessage's fields as a hand-written protobuf
+// message. It's encoded/decoded via gogo/protobuf's reflection-based
+// Marshal/Unmarshal, so no protoc-generated code is required.
+type logMessageProto struct {
+	Line               string `protobuf:"bytes,1,opt,name=line,proto3"`
+	Source             string `protobuf:"bytes,2,opt,name=source,proto3"`
+	Partial            bool   `protobuf:"varint,3,opt,name=partial,proto3"`
+	TimestampNano      int64  `protobuf:"varint,4,opt,name=timestamp_nano,proto3"`
+	ContainerId        string `protobuf:"bytes,5,opt,name=container_id,proto3"`
+	ContainerName      string `protobuf:"bytes,6,opt,name=container_name,proto3"`
+	ContainerImageId   string `protobuf:"bytes,7,opt,name=container_image_id,proto3"`
+	ContainerImageName string `protobuf:"bytes,8,opt,name=container_image_name,proto3"`
+	Hostname           string `protobuf:"bytes,9,opt,name=hostname,proto3"`
+	Tag                string `protobuf:"bytes,10,opt,name=tag,proto3"`
+}
+
+func (m *logMessageProto) Reset()         { *m = logMessageProto{} }
+func (m *logMessageProto) String() string { return proto.CompactTextString(m) }
+func (m *logMessageProto) ProtoMessage()  {}
+
+// protobufSerializer encodes a LogMessage as a logMessageProto.
+type protobufSerializer struct{}
+
+func (protobufSerializer) Name() string { return "protobuf" }
+
+func (protobufSerializer) Serialize(msg LogMessage) ([]byte, error) {
+	return proto.Marshal(&logMessageProto{
+		Line:               msg.Line,
+		Source:             msg.Source,
+		Partial:            msg.Partial,
+		TimestampNano:      msg.Timestamp.UnixNano(),
+		ContainerId:        msg.ContainerId,
+		ContainerName:      msg.ContainerName,
+		ContainerImageId:   msg.ContainerImageId,
+		ContainerImageName: msg.ContainerImageName,
+		Hostname:           msg.Hostname,
+		Tag:                msg.Tag,
+	})
+}
+
+func (protobufSerializer) Deserialize(data []byte) (LogMessage, error) {
+	var m logMessageProto
+	if err := proto.Unmarshal(data, &m); err != nil {
+		return LogMessage{}, err
+	}
+
+	return LogMessage{
+		Line:               m.Line,
+		Source:             m.Source,
+		Partial:            m.Partial,
+		Timestamp:          time.Unix(0, m.TimestampNano),
+		ContainerId:        m.ContainerId,
+		ContainerName:      m.ContainerName,
+		ContainerImageId:   m.ContainerImageId,
+		ContainerImageName: m.ContainerImageName,
+		Hostname:           m.Hostname,
+		Tag:                m.Tag,
+	}, nil
+}
+
+// avroLogMessageSchema is the Avro schema registered for every topic's
+// "<topic>-value" subject, mirroring LogMessage's fields.
+const avroLogMessageSchema = `{
+	"type": "record",
+	"name": "LogMessage",
+	"fields": [
+		{"name": "line", "type": "string"},
+		{"name": "source", "type": "string"},
+		{"name": "partial", "type": "boolean"},
+		{"name": "timestamp_nano", "type": "long"},
+		{"name": "container_id", "type": "string"},
+		{"name": "container_name", "type": "string"},
+		{"name": "container_image_id", "type": "string"},
+		{"name": "container_image_name", "type": "string"},
+		{"name": "hostname", "type": "string"},
+		{"name": "tag", "type": "string"}
+	]
+}`
+
+// avroLogMessage is the Avro-tagged shape encoded/decoded against
+// avroLogMessageSchema.
+type avroLogMessage struct {
+	Line               string `avro:"line"`
+	Source             string `avro:"source"`
+	Partial            bool   `avro:"partial"`
+	TimestampNano      int64  `avro:"timestamp_nano"`
+	ContainerId        string `avro:"container_id"`
+	ContainerName      string `avro:"container_name"`
+	ContainerImageId   string `avro:"container_image_id"`
+	ContainerImageName string `avro:"container_image_name"`
+	Hostname           string `avro:"hostname"`
+	Tag                string `avro:"tag"`
+}
+
+// schemaRegistry is the subset of registry.Client's methods the avro
+// serializer needs, so tests can fake it without standing up a real Schema
+// Registry HTTP endpoint.
+type schemaRegistry interface {
+	IsRegistered(ctx context.Context, subject, schema string) (int, avro.Schema, error)
+	CreateSchema(ctx context.Context, subject, schema string, refs ...registry.SchemaReference) (int, avro.Schema, error)
+	GetSchema(ctx context.Context, id int) (avro.Schema, error)
+}
+
+// avroSerializer encodes/decodes a LogMessage as Avro, framed with the
+// Confluent wire format: a 0x0 magic byte, a 4-byte big-endian schema ID,
+// then the Avro-encoded payload. The schema ID is registered against
+// subject (conventionally "<topic>-value") lazily, on first use.
+type avroSerializer struct {
+	client  schemaRegistry
+	subject string
+
+	mu       sync.Mutex
+	schemaID int
+	schema   avro.Schema
+}
+
+// newAvroSerializer builds an avroSerializer that registers/fetches schemas
+// for subject against client.
+func newAvroSerializer(client schemaRegistry, subject string) *avroSerializer {
+	return &avroSerializer{client: client, subject: subject}
+}
+
+func (s *avroSerializer) Name() string { return "avro" }
+
+func (s *avroSerializer) Serialize(msg LogMessage) ([]byte, error) {
+	schema, id, err := s.registeredSchema()
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := avro.Marshal(schema, &avroLogMessage{
+		Line:               msg.Line,
+		Source:             msg.Source,
+		Partial:            msg.Partial,
+		TimestampNano:      msg.Timestamp.UnixNano(),
+		ContainerId:        msg.ContainerId,
+		ContainerName:      msg.ContainerName,
+		ContainerImageId:   msg.ContainerImageId,
+		ContainerImageName: msg.ContainerImageName,
+		Hostname:           msg.Hostname,
+		Tag:                msg.Tag,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	framed := make([]byte, 5+len(body))
+	framed[0] = 0
+	binary.BigEndian.PutUint32(framed[1:5], uint32(id))
+	copy(framed[5:], body)
+	return framed, nil
+}
+
+// registeredSchema returns the schema and ID registered for s.subject,
+// registering it with the Schema Registry on first use.
+func (s *avroSerializer) registeredSchema() (avro.Schema, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.schema != nil {
+		return s.schema, s.schemaID, nil
+	}
+
+	ctx := context.Background()
+
+	id, schema, err := s.client.IsRegistered(ctx, s.subject, avroLogMessageSchema)
+	if err != nil {
+		id, schema, err = s.client.CreateSchema(ctx, s.subject, avroLogMessageSchema)
+		if err != nil {
+			return nil, 0, fmt.Errorf("registering avro schema for %s: %w", s.subject, err)
+		}
+	}
+
+	s.schema = schema
+	s.schemaID = id
+	return schema, id, nil
+}
+
+func (s *avroSerializer) Deserialize(data []byte) (LogMessage, error) {
+	if len(data) < 5 || data[0] != 0 {
+		return LogMessage{}, fmt.Errorf("avro: missing Confluent wire-format header")
+	}
+
+	id := int(binary.BigEndian.Uint32(data[1:5]))
+
+	schema, err := s.client.GetSchema(context.Background(), id)
+	if err != nil {
+		return LogMessage{}, fmt.Errorf("fetching avro schema %d: %w", id, err)
+	}
+
+	var m avroLogMessage
+	if err := avro.Unmarshal(schema, data[5:], &m); err != nil {
+		return LogMessage{}, err
+	}
+
+	return LogMessage{
+		Line:               m.Line,
+		Source:             m.Source,
+		Partial:            m.Partial,
+		Timestamp:          time.Unix(0, m.TimestampNano),
+		ContainerId:        m.ContainerId,
+		ContainerName:      m.ContainerName,
+		ContainerImageId:   m.ContainerImageId,
+		ContainerImageName: m.ContainerImageName,
+		Hostname:           m.Hostname,
+		Tag:                m.Tag,
+	}, nil
+}
+
+// serializerForName returns the Serializer registered for name, or an error
+// if name isn't recognised. newAvro is only invoked (and may fail) when name
+// is "avro", since building it requires a reachable Schema Registry.
+func serializerForName(name string, newAvro func() (Serializer, error)) (Serializer, error) {
+	switch name {
+	case "", defaultSerializerName:
+		return jsonSerializer{}, nil
+	case "protobuf":
+		return protobufSerializer{}, nil
+	case "avro":
+		return newAvro()
+	default:
+		return nil, fmt.Errorf("unknown serializer %q", name)
+	}
+}
+
+// getSerializerForContainer resolves the Serializer to use for info's
+// messages on topic, preferring the per-container serializer/schema_registry_*
+// driver options over d's defaults.
+func getSerializerForContainer(d *KafkaDriver, info logger.Info, topic string) (Serializer, error) {
+	name := optForContainer(info, serializerOpt, d.serializerName)
+
+	return serializerForName(name, func() (Serializer, error) {
+		url := optForContainer(info, schemaRegistryURLOpt, d.schemaRegistryURL)
+		if url == "" {
+			return nil, fmt.Errorf("serializer=avro requires --log-opt %s or a driver-level schema registry URL", schemaRegistryURLOpt)
+		}
+
+		auth := optForContainer(info, schemaRegistryAuthOpt, d.schemaRegistryAuth)
+
+		client, err := newSchemaRegistryClient(url, auth)
+		if err != nil {
+			return nil, err
+		}
+
+		return newAvroSerializer(client, topic+"-value"), nil
+	})
+}
+
+// newSchemaRegistryClient builds a registry.Client for url, applying HTTP
+// basic auth when auth is set as "username:password".
+func newSchemaRegistryClient(url string, auth string) (*registry.Client, error) {
+	var opts []registry.ClientFunc
+
+	if user, pass, ok := strings.Cut(auth, ":"); ok {
+		opts = append(opts, registry.WithBasicAuth(user, pass))
+	}
+
+	return registry.NewClient(url, opts...)
+}
+
+// logMessageDecoder resolves the Serializer that produced a given Kafka
+// record (via serializerHeader, defaulting to JSON for older records) so the
+// reader can decode a topic that has seen more than one serializer over its
+// lifetime. avro is nil unless info/topic has a Schema Registry configured.
+type logMessageDecoder struct {
+	json     Serializer
+	protobuf Serializer
+	avro     Serializer
+}
+
+// newLogMessageDecoder builds the decoder used to read back info's messages
+// on topic, wiring up an avro Serializer only if a Schema Registry is
+// configured for this container.
+func newLogMessageDecoder(d *KafkaDriver, info logger.Info, topic string) *logMessageDecoder {
+	dec := &logMessageDecoder{json: jsonSerializer{}, protobuf: protobufSerializer{}}
+
+	url := optForContainer(info, schemaRegistryURLOpt, d.schemaRegistryURL)
+	if url == "" {
+		return dec
+	}
+
+	auth := optForContainer(info, schemaRegistryAuthOpt, d.schemaRegistryAuth)
+	client, err := newSchemaRegistryClient(url, auth)
+	if err != nil {
+		return dec
+	}
+
+	dec.avro = newAvroSerializer(client, topic+"-value")
+	return dec
+}
+
+// decode resolves msg's serializer from serializerHeader and deserializes
+// its value, returning false if the serializer is unknown/unconfigured or
+// decoding fails.
+func (d *logMessageDecoder) decode(msg *sarama.ConsumerMessage) (LogMessage, bool) {
+	name, ok := recordHeaderValue(msg.Headers, serializerHeader)
+	if !ok {
+		name = defaultSerializerName
+	}
+
+	var serializer Serializer
+	switch name {
+	case defaultSerializerName:
+		serializer = d.json
+	case "protobuf":
+		serializer = d.protobuf
+	case "avro":
+		serializer = d.avro
+	}
+
+	if serializer == nil {
+		return LogMessage{}, false
+	}
+
+	logMsg, err := serializer.Deserialize(msg.Value)
+	if err != nil {
+		return LogMessage{}, false
+	}
+
+	return logMsg, true
+}